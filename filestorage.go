@@ -15,25 +15,54 @@
 package certmagic
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"path"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"sync"
 	"time"
 )
 
+// storeContextWriteHook, if non-nil, wraps the temp-file writer
+// StoreContext writes value through. It exists only so tests can inject
+// a fault partway through the real atomic-write path (rather than
+// reimplementing that path themselves) and is never set outside tests.
+var storeContextWriteHook func(io.Writer) io.Writer
+
 // FileStorage facilitates forming file paths derived from a root
 // directory. It is used to get file paths in a consistent,
 // cross-platform way or persisting ACME assets on the file system.
 type FileStorage struct {
 	Path string
 
-	fileStorageNameLocks   map[string]*fileStorageWaiter
-	fileStorageNameLocksMu sync.Mutex
+	// Locker coordinates Lock/Unlock across however many instances share
+	// Path. If nil, a FileLocker rooted at Path's locks directory is used,
+	// which is correct for a single machine but not for Path being shared
+	// (e.g. over NFS) across machines; set Locker explicitly in that case.
+	Locker Locker
+
+	leases        map[string]Lease
+	leasesMu      sync.Mutex
+	defaultLocker *FileLocker
+
+	cleanTempOnce sync.Once
+}
+
+// NewFileStorage returns a new FileStorage rooted at path. It also
+// removes, right away, leftover atomic-write temp files older than an
+// hour (see StoreContext) from a previous, possibly crashed, process
+// sharing path, so they don't accumulate forever. A bare
+// FileStorage{Path: path} literal does the same on its first Store.
+func NewFileStorage(path string) *FileStorage {
+	fs := &FileStorage{Path: path}
+	fs.cleanTempOnce.Do(fs.cleanStaleTempFiles)
+	return fs
 }
 
 // Exists returns true if key exists in fs.
@@ -44,16 +73,93 @@ func (fs *FileStorage) Exists(key string) bool {
 
 // Store saves value at key.
 func (fs *FileStorage) Store(key string, value []byte) error {
+	return fs.StoreContext(context.Background(), key, value)
+}
+
+// StoreContext is like Store but returns ctx.Err() without writing
+// anything if ctx is already cancelled when it is called; ctx is not
+// checked again once the write has begun.
+//
+// The value is written to a temp file in the same directory as the
+// destination, fsynced, and then renamed over the destination, so a
+// crash mid-write can never leave a torn, unparseable file behind; the
+// destination either has its old contents or its new ones, never a
+// partial write. On POSIX the parent directory is fsynced too, since a
+// rename is not itself guaranteed durable until that happens.
+func (fs *FileStorage) StoreContext(ctx context.Context, key string, value []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	fs.cleanTempOnce.Do(fs.cleanStaleTempFiles)
+
 	filename := fs.Filename(key)
-	err := os.MkdirAll(filepath.Dir(filename), 0700)
+	dir := filepath.Dir(filename)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(dir, fmt.Sprintf("%s.tmp-%d-*", filepath.Base(filename), os.Getpid()))
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile(filename, value, 0600)
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName) // no-op once the rename below succeeds
+
+	var w io.Writer = tmp
+	if storeContextWriteHook != nil {
+		w = storeContextWriteHook(w)
+	}
+	if _, err := w.Write(value); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpName, 0600); err != nil {
+		return err
+	}
+
+	if err := atomicReplace(tmpName, filename); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// cleanStaleTempFiles removes leftover Store temp files (see
+// StoreContext) older than an hour, which can only exist if a previous
+// process crashed between creating one and renaming it into place.
+func (fs *FileStorage) cleanStaleTempFiles() {
+	cutoff := time.Now().Add(-1 * time.Hour)
+	_ = filepath.Walk(fs.Path, func(fpath string, info os.FileInfo, err error) error {
+		if err != nil || info == nil || info.IsDir() {
+			return nil
+		}
+		if !strings.Contains(info.Name(), ".tmp-") {
+			return nil
+		}
+		if info.ModTime().Before(cutoff) {
+			os.Remove(fpath)
+		}
+		return nil
+	})
 }
 
 // Load retrieves the value at key.
 func (fs *FileStorage) Load(key string) ([]byte, error) {
+	return fs.LoadContext(context.Background(), key)
+}
+
+// LoadContext is like Load but returns ctx.Err() without reading
+// anything if ctx is already cancelled when it is called.
+func (fs *FileStorage) LoadContext(ctx context.Context, key string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	contents, err := ioutil.ReadFile(fs.Filename(key))
 	if os.IsNotExist(err) {
 		return nil, ErrNotExist(err)
@@ -73,6 +179,12 @@ func (fs *FileStorage) Delete(key string) error {
 
 // List returns all keys that match prefix.
 func (fs *FileStorage) List(prefix string, recursive bool) ([]string, error) {
+	return fs.ListContext(context.Background(), prefix, recursive)
+}
+
+// ListContext is like List, except that it aborts and returns
+// ctx.Err() if ctx is cancelled before the walk finishes.
+func (fs *FileStorage) ListContext(ctx context.Context, prefix string, recursive bool) ([]string, error) {
 	var keys []string
 	walkPrefix := fs.Filename(prefix)
 
@@ -80,6 +192,9 @@ func (fs *FileStorage) List(prefix string, recursive bool) ([]string, error) {
 		if err != nil {
 			return err
 		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
 		if info == nil {
 			return fmt.Errorf("%s: file info is nil", fpath)
 		}
@@ -155,114 +270,74 @@ func dataDir() string {
 // Lock obtains a lock named by the given key. It blocks
 // until the lock can be obtained or an error is returned.
 func (fs *FileStorage) Lock(key string) error {
-	// can't defer the unlock because we might have
-	// to Wait() for a while before returning, so we're
-	// careful to unlock at all the right places
-	fs.fileStorageNameLocksMu.Lock()
+	return fs.LockContext(context.Background(), key)
+}
 
-	if fs.fileStorageNameLocks == nil {
-		fs.fileStorageNameLocks = make(map[string]*fileStorageWaiter)
+// LockContext is like Lock, except that it also returns early with
+// ctx.Err() if ctx is cancelled before the lock can be obtained. The
+// lock itself, once obtained, is not tied to ctx; it still must be
+// released with Unlock.
+func (fs *FileStorage) LockContext(ctx context.Context, key string) error {
+	lease, err := fs.locker().Acquire(ctx, key)
+	if err != nil {
+		return err
 	}
 
-	// see if lock already exists within this process - allows
-	// for faster unlocking since we don't have to poll the disk
-	fw, ok := fs.fileStorageNameLocks[key]
-	if ok {
-		// lock already created within process, let caller wait on it
-		fs.fileStorageNameLocksMu.Unlock()
-		fw.Wait()
-		return nil
+	fs.leasesMu.Lock()
+	if fs.leases == nil {
+		fs.leases = make(map[string]Lease)
 	}
+	fs.leases[key] = lease
+	fs.leasesMu.Unlock()
 
-	// attempt to persist lock to disk by creating lock file
-
-	lockDir := fs.lockDir()
-	// since there isn't already a waiter for the lock, make one
-	fw = &fileStorageWaiter{
-		key:      key,
-		filename: filepath.Join(lockDir, StorageKeys.safe(key)+".lock"),
-		wg:       new(sync.WaitGroup),
-	}
-	fw.wg.Add(1)
-	fs.fileStorageNameLocks[key] = fw
-	fs.fileStorageNameLocksMu.Unlock()
-
-	for {
-		// parent dir must exist
-		if err := os.MkdirAll(lockDir, 0700); err != nil {
-			return err
-		}
-
-		// create the file in a special mode such that an
-		// error is returned if it already exists
-		lf, err := os.OpenFile(fw.filename, os.O_CREATE|os.O_EXCL, 0644)
-		switch {
-		case err == nil:
-			// cool, we got the lock right away
-			lf.Close()
-			return nil
-		case os.IsExist(err):
-			// another process has the lock
-			info, err := os.Stat(fw.filename)
-			switch {
-			case err != nil:
-			case fileLockIsStale(info):
-				log.Printf("[INFO][%s] Lock for '%s' is stale; removing then retrying: %s",
-					fs, key, fw.filename)
-				os.Remove(fw.filename)
-			default:
-				time.Sleep(1 * time.Second)
-			}
-		default:
-			// otherwise, this was some unexpected error
-
-			// we called wg.Add(1) above but didn't actually acquire the lock
-			fw.wg.Done()
-			return err
-		}
-	}
+	return nil
 }
 
 // Unlock releases the lock for name.
 func (fs *FileStorage) Unlock(key string) error {
-	fs.fileStorageNameLocksMu.Lock()
-	defer fs.fileStorageNameLocksMu.Unlock()
+	fs.leasesMu.Lock()
+	defer fs.leasesMu.Unlock()
 
-	fw, ok := fs.fileStorageNameLocks[key]
+	lease, ok := fs.leases[key]
 	if !ok {
 		return fmt.Errorf("FileStorage: no lock to release for %s", key)
 	}
+	delete(fs.leases, key)
 
-	// remove lock file
-	os.Remove(fw.filename)
-
-	// clean up in memory
-	fw.wg.Done()
-	delete(fs.fileStorageNameLocks, key)
-
-	return nil
+	return lease.Release()
 }
 
 // UnlockAllObtained removes all locks obtained
 // by this instance of fs.
 func (fs *FileStorage) UnlockAllObtained() {
-	if fs.fileStorageNameLocks == nil {
-		fs.fileStorageNameLocks = make(map[string]*fileStorageWaiter)
+	fs.leasesMu.Lock()
+	keys := make([]string, 0, len(fs.leases))
+	for key := range fs.leases {
+		keys = append(keys, key)
 	}
-	for key, fw := range fs.fileStorageNameLocks {
-		err := fs.Unlock(fw.key)
-		if err != nil {
+	fs.leasesMu.Unlock()
+
+	for _, key := range keys {
+		if err := fs.Unlock(key); err != nil {
 			log.Printf("[ERROR][%s] Releasing obtained lock for %s: %v", fs, key, err)
 		}
 	}
 }
 
-func (fs *FileStorage) lockFileStale(filename string) bool {
-	info, err := os.Stat(filename)
-	if err != nil {
-		return true // no good way to handle this, really...
+// locker returns the Locker that fs uses to coordinate Lock/Unlock: fs.Locker
+// if one was explicitly configured, or otherwise a FileLocker rooted at
+// fs.lockDir() so unrelated FileStorage values sharing the same Path still
+// contend for the same OS-level locks.
+func (fs *FileStorage) locker() Locker {
+	fs.leasesMu.Lock()
+	defer fs.leasesMu.Unlock()
+	if fs.Locker != nil {
+		return fs.Locker
+	}
+	if fs.defaultLocker == nil {
+		fs.defaultLocker = &FileLocker{Dir: fs.lockDir()}
 	}
-	return fileLockIsStale(info)
+	return fs.defaultLocker
 }
 
 func (fs *FileStorage) lockDir() string {
@@ -273,45 +348,4 @@ func (fs *FileStorage) String() string {
 	return "FileStorage:" + fs.Path
 }
 
-// fileStorageWaiter waits for a file to disappear; it
-// polls the file system to check for the existence of
-// a file. It also uses a WaitGroup to optimize the
-// polling in the case when this process is the only
-// one waiting. (Other processes that are waiting for
-// the lock will still block, but must wait for the
-// polling to get their answer.)
-type fileStorageWaiter struct {
-	key      string
-	filename string
-	wg       *sync.WaitGroup
-}
-
-// Wait waits until the lock at fw.filename is
-// released or until it becomes stale.
-func (fw *fileStorageWaiter) Wait() {
-	start := time.Now()
-	fw.wg.Wait()
-	for time.Since(start) < staleLockDuration {
-		info, err := os.Stat(fw.filename)
-		if err != nil {
-			return
-		}
-		if fileLockIsStale(info) {
-			return
-		}
-		time.Sleep(1 * time.Second)
-	}
-}
-
-func fileLockIsStale(info os.FileInfo) bool {
-	if info == nil {
-		return true
-	}
-	return time.Since(info.ModTime()) > staleLockDuration
-}
-
 var _ Storage = (*FileStorage)(nil)
-
-// staleLockDuration is the length of time
-// before considering a lock to be stale.
-const staleLockDuration = 2 * time.Hour
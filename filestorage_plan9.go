@@ -0,0 +1,32 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build plan9
+// +build plan9
+
+package certmagic
+
+import "os"
+
+// atomicReplace renames oldname over newname; Plan 9 guarantees this is
+// atomic with respect to other processes observing newname.
+func atomicReplace(oldname, newname string) error {
+	return os.Rename(oldname, newname)
+}
+
+// syncDir is a no-op: Plan 9 has no directory-fsync primitive, and its
+// file servers commit renames synchronously.
+func syncDir(dir string) error {
+	return nil
+}
@@ -0,0 +1,130 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileStorage(t *testing.T) {
+	StorageTestSuite(t, func() Storage {
+		dir, err := ioutil.TempDir("", "certmagic-filestorage-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { os.RemoveAll(dir) })
+		return NewFileStorage(dir)
+	})
+}
+
+// faultyWriter fails after writing n bytes, simulating a process that
+// crashes partway through a write.
+type faultyWriter struct {
+	w io.Writer
+	n int
+}
+
+func (fw *faultyWriter) Write(p []byte) (int, error) {
+	if len(p) > fw.n {
+		p = p[:fw.n]
+	}
+	written, err := fw.w.Write(p)
+	fw.n -= written
+	if err != nil {
+		return written, err
+	}
+	if fw.n == 0 {
+		return written, fmt.Errorf("simulated crash mid-write")
+	}
+	return written, nil
+}
+
+// TestFileStorageStoreCrashLeavesPreviousValueIntact simulates a crash
+// partway through StoreContext by hooking storeContextWriteHook to wrap
+// the real temp-file writer in a faultyWriter that fails before the
+// write completes. Because the hook runs inside StoreContext itself,
+// this exercises the actual atomic-write code path -- temp file,
+// partial write, simulated crash, no rename -- rather than a hand-rolled
+// stand-in for it, and checks that the previously committed value is
+// still the one Load returns afterward.
+func TestFileStorageStoreCrashLeavesPreviousValueIntact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certmagic-filestorage-crash-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fs := NewFileStorage(dir)
+	const key, goodValue = "cert.key", "the original, good value"
+	if err := fs.Store(key, []byte(goodValue)); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+
+	storeContextWriteHook = func(w io.Writer) io.Writer {
+		return &faultyWriter{w: w, n: 4}
+	}
+	defer func() { storeContextWriteHook = nil }()
+
+	err = fs.Store(key, []byte("this write never finishes"))
+	if err == nil {
+		t.Fatal("expected Store to fail from the simulated crash mid-write")
+	}
+
+	got, loadErr := fs.Load(key)
+	if loadErr != nil {
+		t.Fatalf("Load after simulated crash: %v", loadErr)
+	}
+	if string(got) != goodValue {
+		t.Fatalf("Load after simulated crash = %q, want original value %q (torn write must not have clobbered it)", got, goodValue)
+	}
+}
+
+func TestFileStorageCleanStaleTempFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certmagic-filestorage-clean-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	old := filepath.Join(dir, "cert.key.tmp-1-old")
+	if err := ioutil.WriteFile(old, []byte("stale"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	staleTime := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(old, staleTime, staleTime); err != nil {
+		t.Fatal(err)
+	}
+
+	fresh := filepath.Join(dir, "cert.key.tmp-2-fresh")
+	if err := ioutil.WriteFile(fresh, []byte("fresh"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	fs := &FileStorage{Path: dir}
+	fs.cleanStaleTempFiles()
+
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Errorf("stale temp file should have been removed, stat err = %v", err)
+	}
+	if _, err := os.Stat(fresh); err != nil {
+		t.Errorf("fresh temp file should not have been removed: %v", err)
+	}
+}
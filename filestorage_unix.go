@@ -0,0 +1,39 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package certmagic
+
+import "os"
+
+// atomicReplace renames oldname over newname. On POSIX, rename(2) is
+// already atomic with respect to any process observing newname.
+func atomicReplace(oldname, newname string) error {
+	return os.Rename(oldname, newname)
+}
+
+// syncDir fsyncs dir so that a preceding atomicReplace is durable even
+// if the machine loses power immediately afterward; POSIX does not
+// guarantee a rename survives a crash until the directory entry change
+// is itself flushed.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
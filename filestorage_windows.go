@@ -0,0 +1,40 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+// +build windows
+
+package certmagic
+
+import "golang.org/x/sys/windows"
+
+// atomicReplace moves oldname over newname with MOVEFILE_WRITE_THROUGH,
+// which blocks until the move is flushed to disk, so no separate
+// directory fsync is needed as it is on POSIX.
+func atomicReplace(oldname, newname string) error {
+	oldp, err := windows.UTF16PtrFromString(oldname)
+	if err != nil {
+		return err
+	}
+	newp, err := windows.UTF16PtrFromString(newname)
+	if err != nil {
+		return err
+	}
+	return windows.MoveFileEx(oldp, newp, windows.MOVEFILE_REPLACE_EXISTING|windows.MOVEFILE_WRITE_THROUGH)
+}
+
+// syncDir is a no-op on Windows; see atomicReplace.
+func syncDir(dir string) error {
+	return nil
+}
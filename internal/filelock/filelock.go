@@ -0,0 +1,83 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package filelock provides a minimal, cross-platform API for taking an
+// OS-level advisory lock on an open file. Unlike a sentinel file created
+// with O_CREATE|O_EXCL, a lock taken with this package is automatically
+// released by the kernel if the holding process dies, so waiters never
+// have to fall back to a staleness heuristic.
+//
+// The implementation is platform-specific (see filelock_unix.go,
+// filelock_windows.go, and filelock_plan9.go) but the exported API is the
+// same everywhere: Lock blocks until the lock on f is acquired, and
+// Unlock releases it. Both operate on the file descriptor underlying f.
+// On POSIX the fcntl lock belongs to the process and the file's inode,
+// not to f, so another descriptor for the same file opened in the same
+// process does not conflict with it.
+//
+// Lock has no way to honor a context: the underlying primitives
+// (fcntl F_SETLKW, LockFileEx) block in the kernel with no cancellation
+// mechanism once a different process holds the lock. Callers that need
+// a context deadline to apply even when the contending holder is in
+// another process must use LockContext instead, which polls a
+// non-blocking trylock rather than making one blocking syscall.
+package filelock
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+// Lock places an exclusive advisory lock on f, blocking until the lock
+// is acquired. The lock is released when Unlock is called; on POSIX and
+// Windows it is also released when f is closed, while on Plan 9 it is
+// held on a separate descriptor that only Unlock closes. It is also
+// released automatically if the calling process dies while holding it.
+func Lock(f *os.File) error {
+	return lock(f)
+}
+
+// lockContextPollInterval is how often LockContext retries the
+// non-blocking trylock while waiting for ctx.Done() or the lock to free
+// up.
+const lockContextPollInterval = 10 * time.Millisecond
+
+// LockContext is like Lock, but returns ctx.Err() if ctx is cancelled
+// before the lock is acquired -- including while it is held by a
+// different OS process, which a bare blocking Lock can never notice.
+func LockContext(ctx context.Context, f *os.File) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	for {
+		ok, err := tryLock(f)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+		select {
+		case <-time.After(lockContextPollInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Unlock releases a lock previously acquired with Lock or LockContext.
+func Unlock(f *os.File) error {
+	return unlock(f)
+}
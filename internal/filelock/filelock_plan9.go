@@ -0,0 +1,105 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build plan9
+// +build plan9
+
+package filelock
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// lockPollInterval is how often lock retries the exclusive open while
+// waiting for a Plan 9 lock to be released. Plan 9 has no primitive to
+// block until an exclusively-open file becomes available, so this is
+// the best approximation of the "block until acquired" contract that
+// fcntl(F_SETLKW) and LockFileEx give the other platforms.
+const lockPollInterval = 50 * time.Millisecond
+
+// Plan 9 has no fcntl-style byte-range locking, so we approximate an
+// advisory lock using the exclusive-open semantics of ExclOpen: only one
+// file descriptor may hold the file open in exclusive mode at a time,
+// and the OS clears that mode when every descriptor referencing it is
+// closed (including by a crashed process exiting).
+func lock(f *os.File) error {
+	// f was opened by the caller without ExclOpen, so re-open the same
+	// path in exclusive mode and hold that descriptor for the duration
+	// of the lock; Unlock closes it. Retry until it succeeds so that,
+	// like the other platforms, lock blocks rather than returning a
+	// spurious error the first time it finds the file already held.
+	for {
+		ok, err := tryLock(f)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+		time.Sleep(lockPollInterval)
+	}
+}
+
+// tryLock makes a single, non-blocking attempt to obtain the exclusive
+// open f's lock is built on. It reports (false, nil), not an error, if
+// the file is currently held open exclusively by someone else.
+func tryLock(f *os.File) (bool, error) {
+	excl, err := os.OpenFile(f.Name(), os.O_RDWR|os.O_EXCL, 0)
+	if err == nil {
+		plan9Locks.put(f, excl)
+		return true, nil
+	}
+	if os.IsExist(err) || os.IsPermission(err) {
+		return false, nil
+	}
+	// some other, unexpected error (e.g. the file was removed)
+	return false, err
+}
+
+func unlock(f *os.File) error {
+	excl := plan9Locks.take(f)
+	if excl == nil {
+		return nil
+	}
+	return excl.Close()
+}
+
+var plan9Locks = newLockTable()
+
+// lockTable tracks the exclusive-mode descriptor opened on behalf of
+// each *os.File that currently holds a lock.
+type lockTable struct {
+	mu sync.Mutex
+	m  map[*os.File]*os.File
+}
+
+func newLockTable() *lockTable {
+	return &lockTable{m: make(map[*os.File]*os.File)}
+}
+
+func (t *lockTable) put(f, excl *os.File) {
+	t.mu.Lock()
+	t.m[f] = excl
+	t.mu.Unlock()
+}
+
+func (t *lockTable) take(f *os.File) *os.File {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	excl := t.m[f]
+	delete(t.m, f)
+	return excl
+}
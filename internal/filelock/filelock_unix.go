@@ -0,0 +1,81 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package filelock
+
+import (
+	"io"
+	"os"
+	"syscall"
+)
+
+// lock blocks until it obtains an exclusive fcntl(F_SETLKW) lock on f.
+// Because it uses F_SETLKW rather than polling, the call returns as
+// soon as the kernel wakes it up: either because the lock became free,
+// or because the process holding it died and the kernel released the
+// lock on its behalf.
+func lock(f *os.File) error {
+	flock := syscall.Flock_t{
+		Type:   syscall.F_WRLCK,
+		Whence: io.SeekStart,
+		Start:  0,
+		Len:    0, // 0 means "to end of file", i.e. the whole file
+	}
+	for {
+		err := syscall.FcntlFlock(f.Fd(), syscall.F_SETLKW, &flock)
+		if err != syscall.EINTR {
+			return err
+		}
+		// interrupted by a signal; retry
+	}
+}
+
+// tryLock makes a single, non-blocking attempt to obtain an exclusive
+// fcntl(F_SETLK) lock on f. It reports (false, nil), not an error, if
+// the lock is currently held by someone else.
+func tryLock(f *os.File) (bool, error) {
+	flock := syscall.Flock_t{
+		Type:   syscall.F_WRLCK,
+		Whence: io.SeekStart,
+		Start:  0,
+		Len:    0,
+	}
+	for {
+		err := syscall.FcntlFlock(f.Fd(), syscall.F_SETLK, &flock)
+		switch err {
+		case nil:
+			return true, nil
+		case syscall.EINTR:
+			continue
+		case syscall.EACCES, syscall.EAGAIN:
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+}
+
+// unlock releases the lock taken by lock.
+func unlock(f *os.File) error {
+	flock := syscall.Flock_t{
+		Type:   syscall.F_UNLCK,
+		Whence: io.SeekStart,
+		Start:  0,
+		Len:    0,
+	}
+	return syscall.FcntlFlock(f.Fd(), syscall.F_SETLK, &flock)
+}
@@ -0,0 +1,71 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+// +build windows
+
+package filelock
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// lock blocks until it obtains an exclusive lock on f via LockFileEx.
+// Unlike the POSIX path, Windows has no "wait forever" flag other than
+// simply omitting LOCKFILE_FAIL_IMMEDIATELY, so this blocks in the
+// kernel the same way fcntl(F_SETLKW) does on unix.
+func lock(f *os.File) error {
+	var overlapped windows.Overlapped
+	return windows.LockFileEx(
+		windows.Handle(f.Fd()),
+		windows.LOCKFILE_EXCLUSIVE_LOCK,
+		0,
+		1, 0,
+		&overlapped,
+	)
+}
+
+// tryLock makes a single, non-blocking attempt to obtain an exclusive
+// lock on f via LockFileEx. It reports (false, nil), not an error, if
+// the lock is currently held by someone else.
+func tryLock(f *os.File) (bool, error) {
+	var overlapped windows.Overlapped
+	err := windows.LockFileEx(
+		windows.Handle(f.Fd()),
+		windows.LOCKFILE_EXCLUSIVE_LOCK|windows.LOCKFILE_FAIL_IMMEDIATELY,
+		0,
+		1, 0,
+		&overlapped,
+	)
+	if err == nil {
+		return true, nil
+	}
+	if err == windows.ERROR_LOCK_VIOLATION {
+		return false, nil
+	}
+	return false, err
+}
+
+// unlock releases the lock taken by lock.
+func unlock(f *os.File) error {
+	var overlapped windows.Overlapped
+	return windows.UnlockFileEx(
+		windows.Handle(f.Fd()),
+		0,
+		1, 0,
+		&overlapped,
+	)
+}
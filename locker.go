@@ -0,0 +1,447 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/certmagic/internal/filelock"
+)
+
+// heartbeat starts a background goroutine that calls renew every
+// interval until the returned stop function is called. If renew ever
+// returns an error, the heartbeat logs it and gives up rather than
+// retrying forever; from that point on the lease may have been lost,
+// and the holder discovers this the next time it calls Renew itself or
+// tries to use whatever the lock was protecting.
+func heartbeat(interval time.Duration, renew func(context.Context) error) (stop func()) {
+	done := make(chan struct{})
+	var once sync.Once
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := renew(context.Background()); err != nil {
+					log.Printf("[ERROR] renewing lease: %v", err)
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() { once.Do(func() { close(done) }) }
+}
+
+// Locker is a type that can coordinate exclusive access to a key across
+// however many goroutines, processes, or machines need it. It is the
+// extraction point for the locking half of Storage: a Storage backend
+// that has no native locking of its own (for example, an S3 bucket) can
+// still be used safely by multiple clustered instances as long as they
+// all share a Locker pointed at the same backend (Redis, etcd, Consul,
+// or similar).
+type Locker interface {
+	// Acquire blocks until the lock for key is held, ctx is cancelled,
+	// or an error occurs, whichever comes first.
+	Acquire(ctx context.Context, key string) (Lease, error)
+}
+
+// Lease represents a lock held on a key. Lease is returned by a
+// successful call to Locker.Acquire, and must eventually be released
+// with Release.
+//
+// Every Locker in this package except MemLocker starts an internal
+// heartbeat goroutine in Acquire that calls Renew on the holder's behalf until Release is
+// called, so callers do not need to call Renew themselves just to keep
+// a TTL-backed lease (Redis, etcd, Consul) alive. If a heartbeat renewal
+// fails -- for example because the backend is unreachable or another
+// process's lock already expired this one -- it is logged and the
+// heartbeat gives up; the lease may have been lost from that point on; a
+// long-running holder that wants to notice sooner than its next
+// heartbeat tick can still call Renew directly.
+type Lease interface {
+	// Renew extends the lease. For backends with no expiration (such as
+	// an OS advisory lock held for the process lifetime), Renew need
+	// only confirm the lease is still valid.
+	Renew(ctx context.Context) error
+
+	// Release gives up the lease, allowing the next waiter (if any) to
+	// acquire it.
+	Release() error
+}
+
+// MemLocker is an in-process Locker. It does not coordinate with other
+// processes or machines, so it is only suitable for a single-instance
+// deployment or for pairing with a Storage backend (like MemoryStorage)
+// that is itself process-local.
+type MemLocker struct {
+	mu      sync.Mutex
+	waiting map[string]chan struct{}
+}
+
+// Acquire blocks until the lock for key is free, then takes it.
+func (l *MemLocker) Acquire(ctx context.Context, key string) (Lease, error) {
+	for {
+		l.mu.Lock()
+		if l.waiting == nil {
+			l.waiting = make(map[string]chan struct{})
+		}
+		wait, taken := l.waiting[key]
+		if !taken {
+			l.waiting[key] = make(chan struct{})
+			l.mu.Unlock()
+			return &memLease{locker: l, key: key}, nil
+		}
+		l.mu.Unlock()
+
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+type memLease struct {
+	locker *MemLocker
+	key    string
+}
+
+// Renew is a no-op for an in-process lease; it is never invalidated out
+// from under its holder except by Release, so Acquire does not bother
+// starting a heartbeat for it.
+func (l *memLease) Renew(ctx context.Context) error { return ctx.Err() }
+
+func (l *memLease) Release() error {
+	l.locker.mu.Lock()
+	wait, ok := l.locker.waiting[l.key]
+	delete(l.locker.waiting, l.key)
+	l.locker.mu.Unlock()
+	if ok {
+		close(wait)
+	}
+	return nil
+}
+
+// FileLocker is a Locker backed by OS-level advisory locks on files
+// within Dir (see the internal/filelock package). It is the default
+// Locker a FileStorage uses when none is explicitly configured.
+//
+// Within a single process, goroutines first coordinate with an
+// in-memory WaitGroup so that only one of them races for the
+// kernel-level lock; across processes, waiters poll a non-blocking
+// trylock (see filelock.LockContext) until it succeeds, ctx is
+// cancelled, or the lock is released -- which the kernel does
+// automatically if the holding process dies.
+//
+// That in-process fast path is not just an optimization: POSIX fcntl
+// record locks are owned by (pid, inode), not by file descriptor, so a
+// second fcntl(F_SETLKW) from another file descriptor in the *same*
+// process succeeds immediately instead of blocking. Two independently
+// constructed FileLocker (or FileStorage) values pointed at the same
+// directory are an entirely ordinary thing for a caller to do, so the
+// waiter map is therefore keyed globally by absolute lock-file path,
+// not scoped to one FileLocker instance, or this protection would not
+// apply across them.
+type FileLocker struct {
+	Dir string
+
+	// HeartbeatInterval, if nonzero, overrides how often a held lease
+	// touches its lock file's mtime to signal it is still alive. The
+	// default is 30 seconds.
+	HeartbeatInterval time.Duration
+}
+
+var fileLockWaiters sync.Map // absolute lock filename -> *fileLockWaiter
+
+type fileLockWaiter struct {
+	filename string
+	file     *os.File
+	wg       *sync.WaitGroup
+}
+
+func (w *fileLockWaiter) wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		w.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Acquire obtains the lock for key, creating Dir and the lock file
+// within it as needed.
+func (fl *FileLocker) Acquire(ctx context.Context, key string) (Lease, error) {
+	if err := os.MkdirAll(fl.Dir, 0700); err != nil {
+		return nil, err
+	}
+	filename, err := filepath.Abs(filepath.Join(fl.Dir, StorageKeys.safe(key)+".lock"))
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		w := &fileLockWaiter{filename: filename, wg: new(sync.WaitGroup)}
+		w.wg.Add(1)
+		actual, loaded := fileLockWaiters.LoadOrStore(filename, w)
+		if loaded {
+			existing := actual.(*fileLockWaiter)
+			if err := existing.wait(ctx); err != nil {
+				return nil, err
+			}
+			continue // lock was released; race for it again
+		}
+
+		lf, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR, 0644)
+		if err != nil {
+			forgetFileLockWaiter(filename, w)
+			return nil, err
+		}
+		w.file = lf
+
+		if err := filelock.LockContext(ctx, lf); err != nil {
+			lf.Close()
+			forgetFileLockWaiter(filename, w)
+			return nil, err
+		}
+
+		lease := &fileLease{waiter: w, interval: fl.heartbeatInterval()}
+		lease.startHeartbeat()
+		return lease, nil
+	}
+}
+
+func (fl *FileLocker) heartbeatInterval() time.Duration {
+	if fl.HeartbeatInterval > 0 {
+		return fl.HeartbeatInterval
+	}
+	return 30 * time.Second
+}
+
+func forgetFileLockWaiter(filename string, w *fileLockWaiter) {
+	fileLockWaiters.Delete(filename)
+	w.wg.Done()
+}
+
+type fileLease struct {
+	waiter   *fileLockWaiter
+	interval time.Duration
+	stop     func()
+}
+
+// startHeartbeat begins renewing the lease in the background every
+// l.interval until Release stops it; see heartbeat.
+func (l *fileLease) startHeartbeat() {
+	l.stop = heartbeat(l.interval, l.Renew)
+}
+
+// Renew confirms the lease is still valid by checking that the lock
+// file still exists and touching its mtime, mirroring the heartbeat
+// renewal used by distributed Lockers. Because the underlying lock is
+// an OS advisory lock, losing it also means losing the file descriptor,
+// so this mainly guards against the lock file being removed out from
+// under us.
+func (l *fileLease) Renew(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	now := time.Now()
+	return os.Chtimes(l.waiter.filename, now, now)
+}
+
+func (l *fileLease) Release() error {
+	l.stop()
+	// Deliberately not os.Remove'd: fcntl locks are associated with the
+	// inode, not the path. If we unlinked the file here, a concurrent
+	// Acquire elsewhere could create a brand-new file (and inode) at the
+	// same path and take its own, entirely uncontended lock on it, while
+	// another waiter is still waiting for the lock on the old inode -- two
+	// holders, no contention. Leaving the (now-unlocked) file in place
+	// keeps every Acquire locking the same inode, which is what makes the
+	// kernel actually serialize them.
+	err := filelock.Unlock(l.waiter.file)
+	l.waiter.file.Close()
+	forgetFileLockWaiter(l.waiter.filename, l.waiter)
+	return err
+}
+
+// RedisClient is the minimal surface RedisLocker needs from a Redis
+// client: an atomic "set if not exists" used to take the lock, a TTL
+// refresh used to renew it, and a delete used to release it.
+type RedisClient interface {
+	SetNX(ctx context.Context, key, value string, ttl time.Duration) (bool, error)
+	Expire(ctx context.Context, key string, ttl time.Duration) error
+	Del(ctx context.Context, key string) error
+}
+
+// RedisLocker is a Locker backed by a Redis SETNX-style lock, suitable
+// for coordinating ACME issuance across a fleet of instances that share
+// a remote Storage (such as an S3 bucket).
+type RedisLocker struct {
+	Client     RedisClient
+	TTL        time.Duration // how long the lock is held before it expires if not renewed
+	PollPeriod time.Duration // how often to retry while waiting
+}
+
+// Acquire polls the Redis client until it can SETNX the lock key, then
+// starts a heartbeat that calls Expire at TTL/3 to keep the lock alive
+// for as long as the lease is held.
+func (rl *RedisLocker) Acquire(ctx context.Context, key string) (Lease, error) {
+	poll := rl.PollPeriod
+	if poll <= 0 {
+		poll = 1 * time.Second
+	}
+	for {
+		ok, err := rl.Client.SetNX(ctx, redisLockKey(key), "1", rl.TTL)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			lease := &redisLease{client: rl.Client, key: key, ttl: rl.TTL}
+			lease.stop = heartbeat(renewalInterval(rl.TTL), lease.Renew)
+			return lease, nil
+		}
+		select {
+		case <-time.After(poll):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func redisLockKey(key string) string { return "certmagic/locks/" + StorageKeys.safe(key) }
+
+// renewalInterval picks a heartbeat period comfortably inside ttl, so a
+// renewal has multiple chances to land before the backend expires the
+// lock out from under a slow heartbeat tick.
+func renewalInterval(ttl time.Duration) time.Duration {
+	if ttl <= 0 {
+		return 10 * time.Second
+	}
+	if third := ttl / 3; third > 0 {
+		return third
+	}
+	return ttl
+}
+
+type redisLease struct {
+	client RedisClient
+	key    string
+	ttl    time.Duration
+	stop   func()
+}
+
+func (l *redisLease) Renew(ctx context.Context) error {
+	return l.client.Expire(ctx, redisLockKey(l.key), l.ttl)
+}
+
+func (l *redisLease) Release() error {
+	l.stop()
+	return l.client.Del(context.Background(), redisLockKey(l.key))
+}
+
+// EtcdClient is the minimal surface EtcdLocker needs: a lease-based
+// mutex, as provided by etcd's concurrency package.
+type EtcdClient interface {
+	AcquireMutex(ctx context.Context, key string, ttl time.Duration) (EtcdMutex, error)
+}
+
+// EtcdMutex is a held etcd mutex, as returned by EtcdClient.
+type EtcdMutex interface {
+	KeepAlive(ctx context.Context) error
+	Unlock(ctx context.Context) error
+}
+
+// EtcdLocker is a Locker backed by etcd's lease+mutex primitives.
+type EtcdLocker struct {
+	Client EtcdClient
+	TTL    time.Duration
+}
+
+// Acquire blocks in the etcd client until the mutex for key is held,
+// then starts a heartbeat that calls KeepAlive at TTL/3.
+func (el *EtcdLocker) Acquire(ctx context.Context, key string) (Lease, error) {
+	m, err := el.Client.AcquireMutex(ctx, "certmagic/locks/"+StorageKeys.safe(key), el.TTL)
+	if err != nil {
+		return nil, err
+	}
+	lease := &etcdLease{mutex: m}
+	lease.stop = heartbeat(renewalInterval(el.TTL), lease.Renew)
+	return lease, nil
+}
+
+type etcdLease struct {
+	mutex EtcdMutex
+	stop  func()
+}
+
+func (l *etcdLease) Renew(ctx context.Context) error { return l.mutex.KeepAlive(ctx) }
+func (l *etcdLease) Release() error {
+	l.stop()
+	return l.mutex.Unlock(context.Background())
+}
+
+// ConsulClient is the minimal surface ConsulLocker needs: a
+// session-based lock, as provided by the Consul API's sync package.
+type ConsulClient interface {
+	AcquireLock(ctx context.Context, key string, ttl time.Duration) (ConsulLock, error)
+}
+
+// ConsulLock is a held Consul lock, as returned by ConsulClient.
+type ConsulLock interface {
+	Renew(ctx context.Context) error
+	Unlock() error
+}
+
+// ConsulLocker is a Locker backed by Consul sessions.
+type ConsulLocker struct {
+	Client ConsulClient
+	TTL    time.Duration
+}
+
+// Acquire blocks in the Consul client until the session lock for key is
+// held, then starts a heartbeat that calls Renew at TTL/3.
+func (cl *ConsulLocker) Acquire(ctx context.Context, key string) (Lease, error) {
+	lock, err := cl.Client.AcquireLock(ctx, "certmagic/locks/"+StorageKeys.safe(key), cl.TTL)
+	if err != nil {
+		return nil, err
+	}
+	lease := &consulLease{lock: lock}
+	lease.stop = heartbeat(renewalInterval(cl.TTL), lease.Renew)
+	return lease, nil
+}
+
+type consulLease struct {
+	lock ConsulLock
+	stop func()
+}
+
+func (l *consulLease) Renew(ctx context.Context) error { return l.lock.Renew(ctx) }
+func (l *consulLease) Release() error {
+	l.stop()
+	return l.lock.Unlock()
+}
@@ -0,0 +1,429 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/certmagic/internal/filelock"
+)
+
+// lockFileHelperEnvVar, when set in the environment of a re-exec of this
+// test binary (see TestMain), makes it behave as a standalone helper
+// process that takes the OS-level lock on the named file and holds it
+// until killed, rather than running any tests. This is the only way to
+// exercise contention from a genuinely different process: POSIX fcntl
+// record locks are owned by (pid, inode), so two file descriptors open
+// in the *same* process never conflict with each other, no matter how
+// the test tries to fake it.
+const lockFileHelperEnvVar = "CERTMAGIC_LOCKFILE_HELPER"
+
+func TestMain(m *testing.M) {
+	if filename := os.Getenv(lockFileHelperEnvVar); filename != "" {
+		os.Exit(runLockFileHelper(filename))
+	}
+	os.Exit(m.Run())
+}
+
+func runLockFileHelper(filename string) int {
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err := filelock.Lock(f); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Println("locked")
+	time.Sleep(time.Hour) // wait to be killed by the parent test
+	return 0
+}
+
+func TestMemLocker(t *testing.T) {
+	var l MemLocker
+	ctx := context.Background()
+
+	lease, err := l.Acquire(ctx, "key")
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+
+	acquired := make(chan struct{})
+	go func() {
+		second, err := l.Acquire(ctx, "key")
+		if err != nil {
+			t.Errorf("second Acquire: %v", err)
+			return
+		}
+		second.Release()
+		close(acquired)
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("second Acquire returned before first was released")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	if err := lease.Release(); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	<-acquired
+}
+
+func TestMemLockerAcquireContextCancelled(t *testing.T) {
+	var l MemLocker
+	ctx := context.Background()
+
+	lease, err := l.Acquire(ctx, "key")
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	defer lease.Release()
+
+	cctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err := l.Acquire(cctx, "key"); err != cctx.Err() {
+		t.Fatalf("Acquire with cancelled context returned %v, want %v", err, cctx.Err())
+	}
+}
+
+// TestFileLockerExcludesAcrossSequentialAcquisitions checks, over two
+// consecutive Acquire/Release rounds on the same FileLocker, that a
+// concurrent Acquire blocks until the current lease is released. Both
+// contenders are in this process, so the exclusion seen here comes from
+// FileLocker's in-process waiter map; a Release that unlinked the lock
+// file (letting a later Acquire lock a fresh inode) would still pass.
+func TestFileLockerExcludesAcrossSequentialAcquisitions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certmagic-filelocker-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fl := &FileLocker{Dir: dir}
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		lease, err := fl.Acquire(ctx, "key")
+		if err != nil {
+			t.Fatalf("round %d: Acquire: %v", i, err)
+		}
+
+		acquired := make(chan struct{})
+		go func() {
+			second, err := fl.Acquire(ctx, "key")
+			if err != nil {
+				t.Errorf("round %d: concurrent Acquire: %v", i, err)
+				return
+			}
+			second.Release()
+			close(acquired)
+		}()
+
+		select {
+		case <-acquired:
+			t.Fatalf("round %d: concurrent Acquire returned before Release", i)
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		if err := lease.Release(); err != nil {
+			t.Fatalf("round %d: Release: %v", i, err)
+		}
+		<-acquired
+	}
+}
+
+// TestFileLockerTwoInstancesSameDirExclude proves the waiter bookkeeping
+// is scoped per lock-file path rather than per FileLocker value, so two
+// independently constructed FileLockers pointed at the same directory
+// still exclude each other.
+func TestFileLockerTwoInstancesSameDirExclude(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certmagic-filelocker-shared-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	a := &FileLocker{Dir: dir}
+	b := &FileLocker{Dir: dir}
+	ctx := context.Background()
+
+	lease, err := a.Acquire(ctx, "key")
+	if err != nil {
+		t.Fatalf("a.Acquire: %v", err)
+	}
+
+	cctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := b.Acquire(cctx, "key"); err != cctx.Err() {
+		t.Fatalf("b.Acquire on a locked key returned %v, want %v", err, cctx.Err())
+	}
+
+	if err := lease.Release(); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+}
+
+// TestFileLockerAcquireContextCancelledUnderKernelContention holds the
+// lock file's kernel-level lock in a genuinely separate OS process, so
+// FileLocker's in-process waiter map -- which only ever coordinates
+// goroutines inside this process -- cannot see the contention at all,
+// and Acquire is forced down the real, kernel-contended path. It must
+// still honor ctx.Done() there rather than blocking on the underlying
+// syscall (fcntl F_SETLKW / LockFileEx), which has no cancellation of
+// its own.
+func TestFileLockerAcquireContextCancelledUnderKernelContention(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certmagic-filelocker-kernel-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fl := &FileLocker{Dir: dir}
+	filename, err := filepath.Abs(filepath.Join(dir, StorageKeys.safe("key")+".lock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	helper := exec.Command(os.Args[0])
+	helper.Env = append(os.Environ(), lockFileHelperEnvVar+"="+filename)
+	stdout, err := helper.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := helper.Start(); err != nil {
+		t.Fatalf("starting lock-holder helper process: %v", err)
+	}
+	defer helper.Process.Kill()
+
+	if _, err := bufio.NewReader(stdout).ReadString('\n'); err != nil {
+		t.Fatalf("waiting for helper process to take the lock: %v", err)
+	}
+
+	cctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, err := fl.Acquire(cctx, "key"); err != cctx.Err() {
+		t.Fatalf("Acquire contended by a different process returned %v, want %v", err, cctx.Err())
+	}
+
+	if err := helper.Process.Kill(); err != nil {
+		t.Fatal(err)
+	}
+	helper.Wait()
+
+	lease, err := fl.Acquire(context.Background(), "key")
+	if err != nil {
+		t.Fatalf("Acquire after the helper process died: %v", err)
+	}
+	lease.Release()
+}
+
+// fakeRedisClient is an in-memory stand-in for RedisClient, just enough
+// to exercise RedisLocker's Acquire/Renew/Release.
+type fakeRedisClient struct {
+	mu   sync.Mutex
+	keys map[string]bool
+}
+
+func (c *fakeRedisClient) SetNX(ctx context.Context, key, value string, ttl time.Duration) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.keys == nil {
+		c.keys = make(map[string]bool)
+	}
+	if c.keys[key] {
+		return false, nil
+	}
+	c.keys[key] = true
+	return true, nil
+}
+
+func (c *fakeRedisClient) Expire(ctx context.Context, key string, ttl time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.keys[key] {
+		return errors.New("key not held")
+	}
+	return nil
+}
+
+func (c *fakeRedisClient) Del(ctx context.Context, key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.keys, key)
+	return nil
+}
+
+func TestRedisLocker(t *testing.T) {
+	client := &fakeRedisClient{}
+	rl := &RedisLocker{Client: client, TTL: 50 * time.Millisecond, PollPeriod: 5 * time.Millisecond}
+	ctx := context.Background()
+
+	lease, err := rl.Acquire(ctx, "cert")
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	if err := lease.Renew(ctx); err != nil {
+		t.Fatalf("Renew: %v", err)
+	}
+
+	cctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if _, err := rl.Acquire(cctx, "cert"); err != cctx.Err() {
+		t.Fatalf("second Acquire while held returned %v, want %v", err, cctx.Err())
+	}
+
+	if err := lease.Release(); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+
+	lease2, err := rl.Acquire(ctx, "cert")
+	if err != nil {
+		t.Fatalf("Acquire after Release: %v", err)
+	}
+	lease2.Release()
+}
+
+// fakeEtcdClient/fakeEtcdMutex are in-memory stand-ins good enough to
+// exercise EtcdLocker's Acquire/Renew/Release.
+type fakeEtcdClient struct {
+	mu     sync.Mutex
+	locked map[string]bool
+}
+
+func (c *fakeEtcdClient) AcquireMutex(ctx context.Context, key string, ttl time.Duration) (EtcdMutex, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.locked == nil {
+		c.locked = make(map[string]bool)
+	}
+	if c.locked[key] {
+		return nil, errors.New("already locked")
+	}
+	c.locked[key] = true
+	return &fakeEtcdMutex{client: c, key: key}, nil
+}
+
+type fakeEtcdMutex struct {
+	client *fakeEtcdClient
+	key    string
+}
+
+func (m *fakeEtcdMutex) KeepAlive(ctx context.Context) error { return nil }
+
+func (m *fakeEtcdMutex) Unlock(ctx context.Context) error {
+	m.client.mu.Lock()
+	defer m.client.mu.Unlock()
+	delete(m.client.locked, m.key)
+	return nil
+}
+
+func TestEtcdLocker(t *testing.T) {
+	client := &fakeEtcdClient{}
+	el := &EtcdLocker{Client: client, TTL: 50 * time.Millisecond}
+	ctx := context.Background()
+
+	lease, err := el.Acquire(ctx, "cert")
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	if err := lease.Renew(ctx); err != nil {
+		t.Fatalf("Renew: %v", err)
+	}
+	if _, err := el.Acquire(ctx, "cert"); err == nil {
+		t.Fatal("second Acquire while held should have failed")
+	}
+	if err := lease.Release(); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+
+	lease2, err := el.Acquire(ctx, "cert")
+	if err != nil {
+		t.Fatalf("Acquire after Release: %v", err)
+	}
+	lease2.Release()
+}
+
+// fakeConsulClient/fakeConsulLock are in-memory stand-ins good enough to
+// exercise ConsulLocker's Acquire/Renew/Release.
+type fakeConsulClient struct {
+	mu     sync.Mutex
+	locked map[string]bool
+}
+
+func (c *fakeConsulClient) AcquireLock(ctx context.Context, key string, ttl time.Duration) (ConsulLock, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.locked == nil {
+		c.locked = make(map[string]bool)
+	}
+	if c.locked[key] {
+		return nil, errors.New("already locked")
+	}
+	c.locked[key] = true
+	return &fakeConsulLock{client: c, key: key}, nil
+}
+
+type fakeConsulLock struct {
+	client *fakeConsulClient
+	key    string
+}
+
+func (l *fakeConsulLock) Renew(ctx context.Context) error { return nil }
+
+func (l *fakeConsulLock) Unlock() error {
+	l.client.mu.Lock()
+	defer l.client.mu.Unlock()
+	delete(l.client.locked, l.key)
+	return nil
+}
+
+func TestConsulLocker(t *testing.T) {
+	client := &fakeConsulClient{}
+	cl := &ConsulLocker{Client: client, TTL: 50 * time.Millisecond}
+	ctx := context.Background()
+
+	lease, err := cl.Acquire(ctx, "cert")
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	if err := lease.Renew(ctx); err != nil {
+		t.Fatalf("Renew: %v", err)
+	}
+	if _, err := cl.Acquire(ctx, "cert"); err == nil {
+		t.Fatal("second Acquire while held should have failed")
+	}
+	if err := lease.Release(); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+
+	lease2, err := cl.Acquire(ctx, "cert")
+	if err != nil {
+		t.Fatalf("Acquire after Release: %v", err)
+	}
+	lease2.Release()
+}
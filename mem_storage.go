@@ -0,0 +1,214 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStorage is a Storage implementation that keeps everything in
+// memory, backed by a map guarded by a sync.RWMutex. It persists nothing
+// to disk, which makes it a convenient zero-config Storage for unit
+// tests (no temp directories to clean up) and for short-lived
+// deployments where certificate persistence across restarts is neither
+// needed nor wanted.
+//
+// The zero value is a ready-to-use, empty MemoryStorage.
+type MemoryStorage struct {
+	mu     sync.RWMutex
+	files  map[string]memoryFile
+	leases map[string]Lease
+
+	locker MemLocker
+}
+
+type memoryFile struct {
+	contents []byte
+	modified time.Time
+}
+
+// Exists returns true if key exists.
+func (s *MemoryStorage) Exists(key string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.files[key]
+	return ok
+}
+
+// Store saves value at key.
+func (s *MemoryStorage) Store(key string, value []byte) error {
+	return s.StoreContext(context.Background(), key, value)
+}
+
+// StoreContext is like Store but returns ctx.Err() early if ctx is
+// cancelled first.
+func (s *MemoryStorage) StoreContext(ctx context.Context, key string, value []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.files == nil {
+		s.files = make(map[string]memoryFile)
+	}
+	cp := make([]byte, len(value))
+	copy(cp, value)
+	s.files[key] = memoryFile{contents: cp, modified: time.Now()}
+	return nil
+}
+
+// Load retrieves the value at key.
+func (s *MemoryStorage) Load(key string) ([]byte, error) {
+	return s.LoadContext(context.Background(), key)
+}
+
+// LoadContext is like Load but returns ctx.Err() early if ctx is
+// cancelled first.
+func (s *MemoryStorage) LoadContext(ctx context.Context, key string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	f, ok := s.files[key]
+	if !ok {
+		return nil, ErrNotExist(fmt.Errorf("key does not exist: %s", key))
+	}
+	cp := make([]byte, len(f.contents))
+	copy(cp, f.contents)
+	return cp, nil
+}
+
+// Delete deletes the value at key.
+func (s *MemoryStorage) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.files[key]; !ok {
+		return ErrNotExist(fmt.Errorf("key does not exist: %s", key))
+	}
+	delete(s.files, key)
+	return nil
+}
+
+// List returns all keys that match prefix.
+func (s *MemoryStorage) List(prefix string, recursive bool) ([]string, error) {
+	return s.ListContext(context.Background(), prefix, recursive)
+}
+
+// ListContext is like List but returns ctx.Err() early if ctx is
+// cancelled first.
+func (s *MemoryStorage) ListContext(ctx context.Context, prefix string, recursive bool) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	trimmedPrefix := strings.Trim(prefix, "/")
+	seen := make(map[string]bool)
+	var keys []string
+	for key := range s.files {
+		if trimmedPrefix != "" && key != trimmedPrefix && !strings.HasPrefix(key, trimmedPrefix+"/") {
+			continue
+		}
+		rel := strings.TrimPrefix(strings.TrimPrefix(key, trimmedPrefix), "/")
+		if rel == "" {
+			continue
+		}
+		if !recursive {
+			if i := strings.Index(rel, "/"); i >= 0 {
+				rel = rel[:i]
+			}
+			full := path.Join(prefix, rel)
+			if !seen[full] {
+				seen[full] = true
+				keys = append(keys, full)
+			}
+			continue
+		}
+		// recursive: emit every path segment along the way, not just
+		// the terminal key, mirroring filepath.Walk as used by
+		// FileStorage.List, which visits intermediate directories too
+		segments := strings.Split(rel, "/")
+		for i := range segments {
+			full := path.Join(prefix, strings.Join(segments[:i+1], "/"))
+			if !seen[full] {
+				seen[full] = true
+				keys = append(keys, full)
+			}
+		}
+	}
+	return keys, nil
+}
+
+// Stat returns information about key.
+func (s *MemoryStorage) Stat(key string) (KeyInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	f, ok := s.files[key]
+	if !ok {
+		return KeyInfo{}, ErrNotExist(fmt.Errorf("key does not exist: %s", key))
+	}
+	return KeyInfo{
+		Key:        key,
+		Modified:   f.modified,
+		Size:       int64(len(f.contents)),
+		IsTerminal: true,
+	}, nil
+}
+
+// Lock obtains a lock named by key, blocking until it is obtained or an
+// error occurs.
+func (s *MemoryStorage) Lock(key string) error {
+	return s.LockContext(context.Background(), key)
+}
+
+// LockContext is like Lock, except it returns early with ctx.Err() if
+// ctx is cancelled before the lock can be obtained. Because
+// MemoryStorage never touches disk, the lock is a plain in-process
+// MemLocker: goroutines block on a channel until Unlock, rather than
+// polling anything.
+func (s *MemoryStorage) LockContext(ctx context.Context, key string) error {
+	lease, err := s.locker.Acquire(ctx, key)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	if s.leases == nil {
+		s.leases = make(map[string]Lease)
+	}
+	s.leases[key] = lease
+	s.mu.Unlock()
+	return nil
+}
+
+// Unlock releases the lock for key.
+func (s *MemoryStorage) Unlock(key string) error {
+	s.mu.Lock()
+	lease, ok := s.leases[key]
+	delete(s.leases, key)
+	s.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("MemoryStorage: no lock to release for %s", key)
+	}
+	return lease.Release()
+}
+
+var _ Storage = (*MemoryStorage)(nil)
@@ -0,0 +1,110 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"path"
+	"strings"
+	"time"
+)
+
+// Storage is a type that implements a key-value store with the ability to
+// lock and unlock access to a given key. Keys are arbitrary, slash-separated
+// paths (see the StorageKeys helper for the paths this package uses).
+//
+// Lock, Store, Load and List each have a Context variant (LockContext,
+// StoreContext, LoadContext, ListContext) that callers should prefer when they have a context to propagate, for
+// example a deadline tied to an ACME request. The plain methods are kept
+// for callers that predate contexts, but Storage implementations must
+// still provide both: there is no embeddable helper that derives one set
+// from the other, so implement each plain method as a thin wrapper
+// calling its Context counterpart with context.Background(), the way
+// FileStorage does.
+type Storage interface {
+	// Lock and LockContext acquire the lock for key, blocking until it is
+	// acquired. LockContext returns ctx.Err() if ctx is cancelled before
+	// the lock is acquired.
+	Lock(key string) error
+	LockContext(ctx context.Context, key string) error
+
+	// Unlock releases the lock for key.
+	Unlock(key string) error
+
+	// Store and StoreContext save value at key.
+	Store(key string, value []byte) error
+	StoreContext(ctx context.Context, key string, value []byte) error
+
+	// Load and LoadContext retrieve the value at key.
+	Load(key string) ([]byte, error)
+	LoadContext(ctx context.Context, key string) ([]byte, error)
+
+	// Delete deletes the value at key.
+	Delete(key string) error
+
+	// Exists returns true if key exists.
+	Exists(key string) bool
+
+	// List and ListContext return all keys that match prefix.
+	List(prefix string, recursive bool) ([]string, error)
+	ListContext(ctx context.Context, prefix string, recursive bool) ([]string, error)
+
+	// Stat returns information about key.
+	Stat(key string) (KeyInfo, error)
+}
+
+// KeyInfo holds information about a key in storage.
+// Inspired by the FileInfo type in the standard os package
+// but simplified for key-value storage.
+type KeyInfo struct {
+	Key        string
+	Modified   time.Time
+	Size       int64
+	IsTerminal bool // whether the key is a "file" rather than a "directory"
+}
+
+// ErrNotExist wraps err in an errNotExist value, which Storage
+// implementations return from Load/Stat/Delete when the key does not
+// exist, rather than some other I/O error. The wrapper type is
+// unexported, so only code in this package can test for it.
+func ErrNotExist(err error) error {
+	return errNotExist{err}
+}
+
+// errNotExist is returned by Storage implementations when a key is
+// looked up but does not exist.
+type errNotExist struct{ error }
+
+// storageKeys provides methods for broadly standardized
+// key naming conventions for a Storage implementation.
+type storageKeys struct{}
+
+// StorageKeys provides methods for accessing storage keys
+// for ACME-related data. The presence of this variable does
+// not mean all keys referenced are actually present. The
+// keys only become associated with actual values by using
+// the methods on this type.
+var StorageKeys storageKeys
+
+// safe standardizes a key for use as a filename or other
+// persistent storage key, keeping it short and free of
+// characters that may not be permissible in some storage
+// backends (e.g. file systems).
+func (keys storageKeys) safe(key string) string {
+	key = strings.ToLower(key)
+	key = strings.ReplaceAll(key, "..", "")
+	key = strings.Trim(key, "/ ")
+	return path.Clean(key)
+}
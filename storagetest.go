@@ -0,0 +1,183 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"testing"
+	"time"
+)
+
+// StorageTestSuite exercises the Storage contract against a fresh
+// instance obtained from newStore, so that third-party Storage
+// implementations (S3, Consul, a database, etc.) can be run through the
+// same conformance tests this package uses for FileStorage and
+// MemoryStorage. newStore is called once per subtest and should return
+// an empty, ready-to-use Storage.
+func StorageTestSuite(t *testing.T, newStore func() Storage) {
+	t.Run("StoreLoadDelete", func(t *testing.T) {
+		s := newStore()
+		const key = "sub/path/to/key"
+		const value = "the quick brown fox"
+
+		if s.Exists(key) {
+			t.Fatalf("%s: key should not exist yet", key)
+		}
+		if err := s.Store(key, []byte(value)); err != nil {
+			t.Fatalf("%s: Store: %v", key, err)
+		}
+		if !s.Exists(key) {
+			t.Fatalf("%s: key should exist after Store", key)
+		}
+
+		got, err := s.Load(key)
+		if err != nil {
+			t.Fatalf("%s: Load: %v", key, err)
+		}
+		if !bytes.Equal(got, []byte(value)) {
+			t.Fatalf("%s: Load = %q, want %q", key, got, value)
+		}
+
+		if err := s.Delete(key); err != nil {
+			t.Fatalf("%s: Delete: %v", key, err)
+		}
+		if s.Exists(key) {
+			t.Fatalf("%s: key should not exist after Delete", key)
+		}
+		if _, err := s.Load(key); err == nil {
+			t.Fatalf("%s: Load after Delete should have returned an error", key)
+		}
+	})
+
+	t.Run("Stat", func(t *testing.T) {
+		s := newStore()
+		const key = "stat-me"
+		if err := s.Store(key, []byte("hello")); err != nil {
+			t.Fatalf("%s: Store: %v", key, err)
+		}
+		info, err := s.Stat(key)
+		if err != nil {
+			t.Fatalf("%s: Stat: %v", key, err)
+		}
+		if info.Key != key {
+			t.Errorf("Stat.Key = %q, want %q", info.Key, key)
+		}
+		if info.Size != 5 {
+			t.Errorf("Stat.Size = %d, want 5", info.Size)
+		}
+		if !info.IsTerminal {
+			t.Errorf("Stat.IsTerminal = false, want true for a stored key")
+		}
+	})
+
+	t.Run("List", func(t *testing.T) {
+		s := newStore()
+		keys := []string{"a/1", "a/2", "a/b/3"}
+		for _, key := range keys {
+			if err := s.Store(key, []byte("x")); err != nil {
+				t.Fatalf("%s: Store: %v", key, err)
+			}
+		}
+
+		nonRecursive, err := s.List("a", false)
+		if err != nil {
+			t.Fatalf("List(a, false): %v", err)
+		}
+		sort.Strings(nonRecursive)
+		if want := []string{"a/1", "a/2", "a/b"}; !equalStrings(nonRecursive, want) {
+			t.Errorf("List(a, false) = %v, want %v", nonRecursive, want)
+		}
+
+		recursive, err := s.List("a", true)
+		if err != nil {
+			t.Fatalf("List(a, true): %v", err)
+		}
+		sort.Strings(recursive)
+		if want := []string{"a/1", "a/2", "a/b", "a/b/3"}; !equalStrings(recursive, want) {
+			t.Errorf("List(a, true) = %v, want %v", recursive, want)
+		}
+	})
+
+	t.Run("LockUnlock", func(t *testing.T) {
+		s := newStore()
+		const key = "lock-me"
+
+		if err := s.Lock(key); err != nil {
+			t.Fatalf("Lock: %v", err)
+		}
+
+		unlocked := make(chan struct{})
+		go func() {
+			if err := s.Lock(key); err != nil {
+				t.Errorf("second Lock: %v", err)
+			}
+			close(unlocked)
+		}()
+
+		select {
+		case <-unlocked:
+			t.Fatalf("second Lock returned before first Unlock")
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		if err := s.Unlock(key); err != nil {
+			t.Fatalf("Unlock: %v", err)
+		}
+		<-unlocked
+		if err := s.Unlock(key); err != nil {
+			t.Fatalf("Unlock (second waiter): %v", err)
+		}
+	})
+
+	// LockContextCancel only proves that LockContext honors ctx.Done()
+	// against a holder in this same process and, for a generic Storage
+	// backend, that is as much as this suite can assume: there is no
+	// backend-agnostic way to hold a lock from a genuinely separate
+	// contender. For FileStorage specifically, a held OS-level lock
+	// taken in a different process is also covered, since that failure
+	// mode (a blocking fcntl/LockFileEx call ignoring ctx) can't be
+	// reached from within one process at all -- see
+	// TestFileLockerAcquireContextCancelledUnderKernelContention in
+	// locker_test.go.
+	t.Run("LockContextCancel", func(t *testing.T) {
+		s := newStore()
+		const key = "lock-me-too"
+
+		if err := s.Lock(key); err != nil {
+			t.Fatalf("Lock: %v", err)
+		}
+		defer s.Unlock(key)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		if err := s.LockContext(ctx, key); err != ctx.Err() {
+			t.Fatalf("LockContext on a held key returned %v, want %v", err, ctx.Err())
+		}
+	})
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}